@@ -1,15 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 
 	"github.com/knadh/koanf/maps"
 	yaml "gopkg.in/yaml.v3"
@@ -20,20 +24,131 @@ type config struct {
 	ListenAddress     string                    `yaml:"listenAddress"`
 	ServerConfigs     []*serverConfig           `yaml:"serverConfigs"`
 	UserDataTemplates map[string]map[string]any `yaml:"userDataTemplates"`
+	TLS               *tlsConfig                `yaml:"tls"`
+	EC2Compat         *ec2Config                `yaml:"ec2Compat"`
 
 	configPath string
 	mu         sync.RWMutex
+	cert       atomic.Pointer[tls.Certificate]
+}
+
+// tlsConfig configures HTTPS serving. CertFile and KeyFile are reloaded
+// alongside the rest of the config (on SIGHUP or on-disk change), so certs
+// can be rotated without dropping connections; see config.GetCertificate.
+// Setting ClientCAFile without an explicit ClientAuth defaults ClientAuth
+// to RequireAndVerifyClientCert, so configuring a CA always turns on mTLS.
+type tlsConfig struct {
+	CertFile     string `yaml:"certFile"`
+	KeyFile      string `yaml:"keyFile"`
+	ClientCAFile string `yaml:"clientCAFile,omitempty"`
+	MinVersion   string `yaml:"minVersion,omitempty"`
+	ClientAuth   string `yaml:"clientAuth,omitempty"`
+
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS1.0": tls.VersionTLS10,
+	"TLS1.1": tls.VersionTLS11,
+	"TLS1.2": tls.VersionTLS12,
+	"TLS1.3": tls.VersionTLS13,
+}
+
+var tlsClientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+func (t *tlsConfig) validate() error {
+	if t.CertFile == "" || t.KeyFile == "" {
+		return fmt.Errorf("certFile and keyFile must both be set")
+	}
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate: %w", err)
+	}
+	t.cert = &cert
+
+	if t.ClientCAFile != "" {
+		by, err := os.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("read clientCAFile: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(by) {
+			return fmt.Errorf("clientCAFile %q contains no certificates", t.ClientCAFile)
+		}
+		t.clientCAs = pool
+		if t.ClientAuth == "" {
+			t.ClientAuth = "RequireAndVerifyClientCert"
+		}
+	}
+	if t.MinVersion != "" {
+		if _, ok := tlsVersions[t.MinVersion]; !ok {
+			return fmt.Errorf("unknown tls minVersion %q", t.MinVersion)
+		}
+	}
+	if t.ClientAuth != "" {
+		if _, ok := tlsClientAuthTypes[t.ClientAuth]; !ok {
+			return fmt.Errorf("unknown tls clientAuth %q", t.ClientAuth)
+		}
+	}
+	return nil
 }
 
 type serverConfig struct {
-	Name             string          `yaml:"name"`
-	MatchPatterns    []string        `yaml:"matchPatterns"`
-	InstanceConfig   *instanceConfig `yaml:"instanceConfig"`
-	UserDataTemplate string          `yaml:"userDataTemplate"`
-	Replacements     map[string]any  `yaml:"replacements"`
+	Name              string          `yaml:"name"`
+	MatchPatterns     []string        `yaml:"matchPatterns"`
+	InstanceConfig    *instanceConfig `yaml:"instanceConfig"`
+	UserDataTemplate  string          `yaml:"userDataTemplate"`
+	Replacements      map[string]any  `yaml:"replacements"`
+	NetworkConfig     *networkConfig  `yaml:"networkConfig"`
+	SSHAuthorizedKeys []string        `yaml:"sshAuthorizedKeys,omitempty"`
+
+	compiledMatchers      []*regexp.Regexp
+	renderedUserData      []byte
+	userDataTmpl          *template.Template
+	renderedNetworkConfig []byte
+}
+
+// networkConfig is a cloud-init NoCloud network-config v2 (netplan-style)
+// document. Only version 2 is supported; version 1's list-of-subnets form
+// is not implemented.
+type networkConfig struct {
+	Version   int                          `yaml:"version"`
+	Ethernets map[string]*networkInterface `yaml:"ethernets,omitempty"`
+}
 
-	compiledMatchers []*regexp.Regexp
-	renderedUserData []byte
+type networkInterface struct {
+	Match       *networkMatch       `yaml:"match,omitempty"`
+	SetName     string              `yaml:"set-name,omitempty"`
+	DHCP4       bool                `yaml:"dhcp4,omitempty"`
+	DHCP6       bool                `yaml:"dhcp6,omitempty"`
+	Addresses   []string            `yaml:"addresses,omitempty"`
+	Gateway4    string              `yaml:"gateway4,omitempty"`
+	Gateway6    string              `yaml:"gateway6,omitempty"`
+	Routes      []networkRoute      `yaml:"routes,omitempty"`
+	Nameservers *networkNameservers `yaml:"nameservers,omitempty"`
+}
+
+type networkMatch struct {
+	MACAddress string `yaml:"macaddress,omitempty"`
+	Name       string `yaml:"name,omitempty"`
+}
+
+type networkRoute struct {
+	To     string `yaml:"to"`
+	Via    string `yaml:"via,omitempty"`
+	Metric int    `yaml:"metric,omitempty"`
+}
+
+type networkNameservers struct {
+	Addresses []string `yaml:"addresses,omitempty"`
+	Search    []string `yaml:"search,omitempty"`
 }
 
 type instanceConfig struct {
@@ -83,6 +198,16 @@ func (c *config) validate() error {
 		if sc.UserDataTemplate == "" && len(sc.Replacements) > 0 {
 			return fmt.Errorf("replacers can only be configured when referencing a user data template")
 		}
+		if sc.NetworkConfig != nil {
+			if err := sc.NetworkConfig.validate(); err != nil {
+				return fmt.Errorf("config %q has invalid networkConfig: %w", sc.Name, err)
+			}
+			by, err := yaml.Marshal(sc.NetworkConfig)
+			if err != nil {
+				return fmt.Errorf("render network config: %w", err)
+			}
+			sc.renderedNetworkConfig = by
+		}
 		userData, ok := c.UserDataTemplates[sc.UserDataTemplate]
 		if ok {
 			clone := maps.Copy(userData)
@@ -93,7 +218,29 @@ func (c *config) validate() error {
 			if err != nil {
 				return fmt.Errorf("render user data after replacements: %w", err)
 			}
-			sc.renderedUserData = by
+			// Only pay for text/template rendering when the rendered YAML
+			// actually contains template directives; otherwise fall back to
+			// serving the pure-YAML replacement result as-is.
+			if bytes.Contains(by, []byte("{{")) {
+				tmpl, err := template.New(sc.Name).Funcs(templateFuncs()).Parse(string(by))
+				if err != nil {
+					return fmt.Errorf("parse user data template: %w", err)
+				}
+				logTemplate.Debug("compiled user-data template", "server", sc.Name)
+				sc.userDataTmpl = tmpl
+			} else {
+				sc.renderedUserData = by
+			}
+		}
+	}
+	if c.TLS != nil {
+		if err := c.TLS.validate(); err != nil {
+			return fmt.Errorf("invalid tls config: %w", err)
+		}
+	}
+	if c.EC2Compat != nil && c.EC2Compat.Enabled {
+		if err := c.EC2Compat.validate(c.ServerConfigs); err != nil {
+			return fmt.Errorf("invalid ec2Compat config: %w", err)
 		}
 	}
 	if c.ListenAddress == "" {
@@ -123,21 +270,64 @@ func (c *config) reload() error {
 	c.ServerConfigs = cfg.ServerConfigs
 	c.ListenAddress = cfg.ListenAddress
 	c.ListenPort = cfg.ListenPort
+	c.TLS = cfg.TLS
+	if cfg.TLS != nil {
+		c.cert.Store(cfg.TLS.cert)
+	} else {
+		c.cert.Store(nil)
+	}
+	c.EC2Compat = cfg.EC2Compat
 
 	return nil
 }
 
+// tlsServerConfig returns the *tls.Config to serve with, or nil if TLS
+// isn't configured. GetCertificate reads the most recently loaded
+// certificate on every handshake, so config.reload can rotate it without
+// restarting the listener.
+func (c *config) tlsServerConfig() *tls.Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.TLS == nil {
+		return nil
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if c.TLS.MinVersion != "" {
+		minVersion = tlsVersions[c.TLS.MinVersion]
+	}
+	clientAuth := tls.NoClientCert
+	if c.TLS.ClientAuth != "" {
+		clientAuth = tlsClientAuthTypes[c.TLS.ClientAuth]
+	}
+
+	return &tls.Config{
+		MinVersion: minVersion,
+		ClientAuth: clientAuth,
+		ClientCAs:  c.TLS.clientCAs,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert := c.cert.Load()
+			if cert == nil {
+				return nil, fmt.Errorf("no tls certificate loaded")
+			}
+			return cert, nil
+		},
+	}
+}
+
 func (c config) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	for _, s := range c.ServerConfigs {
-		if s.Match(r.URL.Path) {
-			log.Printf("%s: returning config %q for: %s", r.RemoteAddr, s.Name, r.URL.Path)
-			s.ServeHTTP(w, r)
-			return
+		idx := s.matchIndex(r.URL.Path)
+		if idx < 0 {
+			continue
 		}
+		s.ServeHTTP(w, r, idx)
+		return
 	}
 
+	logHTTP.Info("no serverConfig matched request", "remoteAddr", r.RemoteAddr, "path", r.URL.Path)
 	http.NotFound(w, r)
 }
 
@@ -156,27 +346,86 @@ func (c *serverConfig) loadMatchers() error {
 }
 
 func (c *serverConfig) Match(s string) bool {
-	for _, re := range c.compiledMatchers {
+	return c.matchIndex(s) >= 0
+}
+
+// matchIndex returns the index of the first matchPattern that matches s, or
+// -1 if none do. The index is surfaced in access logs so operators can tell
+// which pattern routed a given request.
+func (c *serverConfig) matchIndex(s string) int {
+	for i, re := range c.compiledMatchers {
 		if re.MatchString(s) {
-			return true
+			return i
+		}
+	}
+	return -1
+}
+
+// matchGroups returns the named capture groups from whichever matchPattern
+// matched s, keyed by group name. It returns nil if no matcher with named
+// groups matched.
+func (c *serverConfig) matchGroups(s string) map[string]string {
+	for _, re := range c.compiledMatchers {
+		m := re.FindStringSubmatch(s)
+		if m == nil {
+			continue
+		}
+		groups := map[string]string{}
+		for i, name := range re.SubexpNames() {
+			if i == 0 || name == "" {
+				continue
+			}
+			groups[name] = m[i]
 		}
+		return groups
 	}
-	return false
+	return nil
 }
 
-func (c serverConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// ServeHTTP serves a single NoCloud request matched by matchPatterns[patternIndex].
+func (c serverConfig) ServeHTTP(w http.ResponseWriter, r *http.Request, patternIndex int) {
 	split := strings.Split(r.URL.Path, "/")
-	switch suffix := split[len(split)-1]; suffix {
+	serial := split[len(split)-2]
+	suffix := split[len(split)-1]
+
+	var chosenSuffix string
+	defer func() {
+		logHTTP.Info("served request",
+			"remoteAddr", r.RemoteAddr,
+			"server", c.Name,
+			"patternIndex", patternIndex,
+			"path", r.URL.Path,
+			"suffix", chosenSuffix,
+		)
+	}()
+
+	switch suffix {
 	case "meta-data":
-		serial := split[len(split)-2]
-		by, err := c.InstanceConfig.RenderMetaData(serial)
+		md, s, err := c.InstanceConfig.buildMetaData(serial)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		chosenSuffix = s
+		by, err := yaml.Marshal(md)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		w.Write(by)
 	case "user-data":
-		w.Write(c.renderedUserData)
+		by, err := c.renderUserData(serial, r.RemoteAddr, c.matchGroups(r.URL.Path))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(by)
+	case "network-config":
+		if c.renderedNetworkConfig == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(c.renderedNetworkConfig)
 	case "vendor-data":
 		break
 	default:
@@ -184,7 +433,42 @@ func (c serverConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// renderUserData returns the rendered user-data document for a request,
+// templating it with the given per-request values if a template was
+// compiled for this serverConfig, or returning the static pure-YAML result
+// otherwise.
+func (c serverConfig) renderUserData(serial, remoteAddr string, match map[string]string) ([]byte, error) {
+	if c.userDataTmpl == nil {
+		return c.renderedUserData, nil
+	}
+	data := userDataTemplateData{
+		Serial:     serial,
+		Hostname:   c.InstanceConfig.Hostname,
+		RemoteAddr: remoteAddr,
+		Match:      match,
+	}
+	var buf bytes.Buffer
+	if err := c.userDataTmpl.Execute(&buf, data); err != nil {
+		logTemplate.Warn("failed to render user-data template", "server", c.Name, "error", err)
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func (c *instanceConfig) RenderMetaData(serial string) ([]byte, error) {
+	md, _, err := c.buildMetaData(serial)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(md)
+}
+
+// buildMetaData computes the metaData fields for serial without marshalling
+// them, so callers that need the individual fields (e.g. the EC2 IMDS
+// compatibility handler) don't have to re-parse rendered YAML. It also
+// returns the generated suffix, if any, so callers can attach it to access
+// logs.
+func (c *instanceConfig) buildMetaData(serial string) (metaData, string, error) {
 	md := metaData{
 		InstanceID:    "i-" + serial,
 		Hostname:      c.Hostname,
@@ -194,7 +478,7 @@ func (c *instanceConfig) RenderMetaData(serial string) ([]byte, error) {
 	if c.EnableHostnameSuffix || c.EnableInstanceIDSuffix {
 		s, err := genSuffix(c.GeneratedSuffixSize)
 		if err != nil {
-			return nil, fmt.Errorf("generate suffix: %w", err)
+			return metaData{}, "", fmt.Errorf("generate suffix: %w", err)
 		}
 		suffix = s
 	}
@@ -205,7 +489,7 @@ func (c *instanceConfig) RenderMetaData(serial string) ([]byte, error) {
 	if c.EnableInstanceIDSuffix {
 		md.InstanceID += suffix
 	}
-	return yaml.Marshal(md)
+	return md, suffix, nil
 }
 
 func genSuffix(n int) (string, error) {
@@ -219,6 +503,47 @@ func genSuffix(n int) (string, error) {
 	return "-" + hex.EncodeToString(by), nil
 }
 
+func (nc *networkConfig) validate() error {
+	if nc.Version == 1 {
+		return fmt.Errorf("networkConfig version 1 (list-of-subnets) is not supported, only version 2")
+	}
+	if nc.Version != 2 {
+		return fmt.Errorf("version must be 2, got %d", nc.Version)
+	}
+	matchNames := map[string]bool{}
+	var defaultGW4, defaultGW6 int
+	for _, eth := range nc.Ethernets {
+		if eth.Match != nil && eth.Match.Name != "" {
+			if matchNames[eth.Match.Name] {
+				return fmt.Errorf("interface name %q is matched by more than one interface", eth.Match.Name)
+			}
+			matchNames[eth.Match.Name] = true
+		}
+
+		if eth.Gateway4 != "" {
+			defaultGW4++
+		}
+		if eth.Gateway6 != "" {
+			defaultGW6++
+		}
+		for _, route := range eth.Routes {
+			switch route.To {
+			case "0.0.0.0/0":
+				defaultGW4++
+			case "::/0":
+				defaultGW6++
+			}
+		}
+	}
+	if defaultGW4 > 1 {
+		return fmt.Errorf("only one default gateway is allowed for IPv4")
+	}
+	if defaultGW6 > 1 {
+		return fmt.Errorf("only one default gateway is allowed for IPv6")
+	}
+	return nil
+}
+
 func (c *instanceConfig) validate() error {
 	if c.Hostname == "" {
 		return fmt.Errorf("hostname field must be set")
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultEC2BasePath = "/latest"
+	maxTokenTTL        = 6 * time.Hour
+	tokenSweepInterval = 10 * time.Minute
+)
+
+// ec2Config reprojects a single serverConfig's data under the EC2 Instance
+// Metadata Service (IMDS) tree, so VM images built for AWS can be
+// bootstrapped against this server without a separate daemon.
+type ec2Config struct {
+	Enabled      bool   `yaml:"enabled"`
+	BasePath     string `yaml:"basePath,omitempty"`
+	ServerName   string `yaml:"serverName,omitempty"`
+	RequireToken bool   `yaml:"requireToken,omitempty"`
+
+	serverConfig *serverConfig
+}
+
+func (e *ec2Config) validate(serverConfigs []*serverConfig) error {
+	if e.BasePath == "" {
+		e.BasePath = defaultEC2BasePath
+	}
+	if e.ServerName != "" {
+		for _, sc := range serverConfigs {
+			if sc.Name == e.ServerName {
+				e.serverConfig = sc
+				break
+			}
+		}
+		if e.serverConfig == nil {
+			return fmt.Errorf("serverName %q does not match any serverConfig", e.ServerName)
+		}
+		return nil
+	}
+	if len(serverConfigs) != 1 {
+		return fmt.Errorf("serverName must be set when more than one serverConfig is defined")
+	}
+	e.serverConfig = serverConfigs[0]
+	return nil
+}
+
+// ec2Handler is mounted at "/" ahead of the normal NoCloud handler, so that
+// EC2Compat's enabled state and basePath can change across a config reload
+// without requiring a process restart to take effect. It serves the EC2
+// IMDS tree for cfg.EC2Compat.serverConfig when enabled and the request
+// path falls under cfg.EC2Compat.BasePath, and otherwise falls through to
+// cfg's own ServeHTTP.
+type ec2Handler struct {
+	cfg *config
+
+	tokensMu sync.Mutex
+	tokens   map[string]time.Time
+
+	metaDataMu  sync.Mutex
+	metaDataFor *serverConfig
+	metaData    metaData
+}
+
+func newEC2Handler(cfg *config) *ec2Handler {
+	h := &ec2Handler{cfg: cfg, tokens: map[string]time.Time{}}
+	go h.sweepTokens()
+	return h
+}
+
+// sweepTokens periodically evicts expired IMDSv2 tokens from h.tokens.
+// validToken already deletes a token once it's looked up past expiry, but
+// tokens that are requested and never redeemed would otherwise sit in the
+// map for up to maxTokenTTL with nothing to reap them.
+func (h *ec2Handler) sweepTokens() {
+	ticker := time.NewTicker(tokenSweepInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		h.tokensMu.Lock()
+		for token, expiry := range h.tokens {
+			if now.After(expiry) {
+				delete(h.tokens, token)
+			}
+		}
+		h.tokensMu.Unlock()
+	}
+}
+
+func (h *ec2Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.cfg.mu.RLock()
+	ec2 := h.cfg.EC2Compat
+	h.cfg.mu.RUnlock()
+	if ec2 == nil || !ec2.Enabled {
+		h.cfg.ServeHTTP(w, r)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, ec2.BasePath)
+	if path == r.URL.Path {
+		h.cfg.ServeHTTP(w, r)
+		return
+	}
+
+	if path == "/api/token" {
+		h.serveToken(w, r)
+		return
+	}
+
+	if ec2.RequireToken && !h.validToken(r.Header.Get("X-aws-ec2-metadata-token")) {
+		http.Error(w, "missing or invalid IMDSv2 token", http.StatusUnauthorized)
+		return
+	}
+
+	sc := ec2.serverConfig
+	switch path {
+	case "/meta-data", "/meta-data/":
+		writeLines(w, "hostname", "instance-id", "local-hostname", "public-keys/")
+	case "/meta-data/instance-id":
+		h.writeMetaDataField(w, sc, func(md metaData) string { return md.InstanceID })
+	case "/meta-data/hostname":
+		h.writeMetaDataField(w, sc, func(md metaData) string { return md.Hostname })
+	case "/meta-data/local-hostname":
+		h.writeMetaDataField(w, sc, func(md metaData) string { return md.LocalHostname })
+	case "/meta-data/public-keys", "/meta-data/public-keys/":
+		if len(sc.SSHAuthorizedKeys) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		writeLines(w, "0=openssh-key")
+	case "/meta-data/public-keys/0", "/meta-data/public-keys/0/":
+		if len(sc.SSHAuthorizedKeys) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		writeLines(w, "openssh-key")
+	case "/meta-data/public-keys/0/openssh-key":
+		if len(sc.SSHAuthorizedKeys) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, sc.SSHAuthorizedKeys[0]+"\n")
+	case "/user-data":
+		by, err := sc.renderUserData("ec2", r.RemoteAddr, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(by)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writeMetaDataField builds this instance's metadata and writes the single
+// field selected by get as a plain-text line, matching IMDS's response
+// format for leaf meta-data paths.
+func (h *ec2Handler) writeMetaDataField(w http.ResponseWriter, sc *serverConfig, get func(metaData) string) {
+	md, err := h.instanceMetaData(sc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, get(md)+"\n")
+}
+
+// instanceMetaData returns sc's metadata, generating it (and any random
+// suffix) once and caching it for reuse. A real EC2 client fetches
+// instance-id, hostname, and local-hostname as separate requests during the
+// same boot, so re-rolling the suffix per request would make those fields
+// mutually inconsistent; the cache is invalidated only when sc changes
+// across a config reload.
+func (h *ec2Handler) instanceMetaData(sc *serverConfig) (metaData, error) {
+	h.metaDataMu.Lock()
+	defer h.metaDataMu.Unlock()
+	if h.metaDataFor == sc {
+		return h.metaData, nil
+	}
+	md, _, err := sc.InstanceConfig.buildMetaData("ec2")
+	if err != nil {
+		return metaData{}, err
+	}
+	h.metaDataFor = sc
+	h.metaData = md
+	return md, nil
+}
+
+func (h *ec2Handler) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ttl := maxTokenTTL
+	if v := r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs <= 0 {
+			http.Error(w, "invalid X-aws-ec2-metadata-token-ttl-seconds", http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(secs) * time.Second
+		if ttl > maxTokenTTL {
+			ttl = maxTokenTTL
+		}
+	}
+
+	token, err := genToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.tokensMu.Lock()
+	h.tokens[token] = time.Now().Add(ttl)
+	h.tokensMu.Unlock()
+
+	logHTTP.Debug("issued IMDSv2 token", "remoteAddr", r.RemoteAddr, "ttl", ttl)
+	w.Header().Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(int(ttl.Seconds())))
+	io.WriteString(w, token)
+}
+
+func (h *ec2Handler) validToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	h.tokensMu.Lock()
+	defer h.tokensMu.Unlock()
+	expiry, ok := h.tokens[token]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(h.tokens, token)
+		return false
+	}
+	return true
+}
+
+func genToken() (string, error) {
+	by := make([]byte, 20)
+	if _, err := rand.Read(by); err != nil {
+		return "", fmt.Errorf("generate token: %w", err)
+	}
+	return hex.EncodeToString(by), nil
+}
+
+func writeLines(w http.ResponseWriter, lines ...string) {
+	io.WriteString(w, strings.Join(lines, "\n")+"\n")
+}
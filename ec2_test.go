@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEC2ConfigValidate(t *testing.T) {
+	scA := &serverConfig{Name: "a"}
+	scB := &serverConfig{Name: "b"}
+
+	t.Run("defaults basePath", func(t *testing.T) {
+		e := &ec2Config{}
+		if err := e.validate([]*serverConfig{scA}); err != nil {
+			t.Fatalf("validate() error = %v", err)
+		}
+		if e.BasePath != defaultEC2BasePath {
+			t.Fatalf("BasePath = %q, want %q", e.BasePath, defaultEC2BasePath)
+		}
+		if e.serverConfig != scA {
+			t.Fatal("expected the sole serverConfig to be selected")
+		}
+	})
+
+	t.Run("requires serverName when multiple serverConfigs exist", func(t *testing.T) {
+		e := &ec2Config{}
+		if err := e.validate([]*serverConfig{scA, scB}); err == nil {
+			t.Fatal("expected an error when serverName is unset and multiple serverConfigs exist")
+		}
+	})
+
+	t.Run("unknown serverName is rejected", func(t *testing.T) {
+		e := &ec2Config{ServerName: "missing"}
+		if err := e.validate([]*serverConfig{scA, scB}); err == nil {
+			t.Fatal("expected an error for an unknown serverName")
+		}
+	})
+
+	t.Run("serverName selects the matching serverConfig", func(t *testing.T) {
+		e := &ec2Config{ServerName: "b"}
+		if err := e.validate([]*serverConfig{scA, scB}); err != nil {
+			t.Fatalf("validate() error = %v", err)
+		}
+		if e.serverConfig != scB {
+			t.Fatal("expected serverConfig b to be selected")
+		}
+	})
+}
+
+func TestEC2HandlerValidToken(t *testing.T) {
+	h := &ec2Handler{tokens: map[string]time.Time{}}
+
+	if h.validToken("") {
+		t.Fatal("empty token should never validate")
+	}
+	if h.validToken("unknown") {
+		t.Fatal("unknown token should not validate")
+	}
+
+	h.tokens["fresh"] = time.Now().Add(time.Hour)
+	if !h.validToken("fresh") {
+		t.Fatal("unexpired token should validate")
+	}
+
+	h.tokens["expired"] = time.Now().Add(-time.Hour)
+	if h.validToken("expired") {
+		t.Fatal("expired token should not validate")
+	}
+	if _, ok := h.tokens["expired"]; ok {
+		t.Fatal("validToken should evict the expired token it found")
+	}
+}
+
+func TestEC2HandlerSweepTokensEvictsExpired(t *testing.T) {
+	h := &ec2Handler{tokens: map[string]time.Time{
+		"expired": time.Now().Add(-time.Minute),
+		"fresh":   time.Now().Add(time.Hour),
+	}}
+
+	now := time.Now()
+	h.tokensMu.Lock()
+	for token, expiry := range h.tokens {
+		if now.After(expiry) {
+			delete(h.tokens, token)
+		}
+	}
+	h.tokensMu.Unlock()
+
+	if _, ok := h.tokens["expired"]; ok {
+		t.Fatal("expired token should have been swept")
+	}
+	if _, ok := h.tokens["fresh"]; !ok {
+		t.Fatal("fresh token should not have been swept")
+	}
+}
+
+func TestEC2HandlerServeToken(t *testing.T) {
+	h := &ec2Handler{tokens: map[string]time.Time{}}
+
+	t.Run("rejects non-PUT methods", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/latest/api/token", nil)
+		rec := httptest.NewRecorder()
+		h.serveToken(rec, req)
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+		}
+	})
+
+	t.Run("rejects an invalid ttl header", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPut, "/latest/api/token", nil)
+		req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "not-a-number")
+		rec := httptest.NewRecorder()
+		h.serveToken(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("clamps a ttl above the maximum", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPut, "/latest/api/token", nil)
+		req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "999999")
+		rec := httptest.NewRecorder()
+		h.serveToken(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+		}
+		if got := rec.Header().Get("X-aws-ec2-metadata-token-ttl-seconds"); got != "21600" {
+			t.Fatalf("ttl header = %q, want clamped to maxTokenTTL (21600)", got)
+		}
+		token := rec.Body.String()
+		if !h.validToken(token) {
+			t.Fatal("issued token should validate")
+		}
+	})
+}
+
+func TestEC2HandlerServeHTTPFallsThroughWhenDisabled(t *testing.T) {
+	cfg := &config{
+		ServerConfigs: []*serverConfig{{Name: "test", compiledMatchers: nil}},
+	}
+	h := newEC2Handler(cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/latest/meta-data/instance-id", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	// With EC2Compat unset, the request should fall through to cfg's own
+	// ServeHTTP, which 404s because no serverConfig matches the path.
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestEC2HandlerServeHTTPRoutesMetaData(t *testing.T) {
+	sc := &serverConfig{
+		Name:           "test",
+		InstanceConfig: &instanceConfig{Hostname: "myhost"},
+	}
+	cfg := &config{
+		ServerConfigs: []*serverConfig{sc},
+		EC2Compat:     &ec2Config{Enabled: true, BasePath: "/latest", serverConfig: sc},
+	}
+	h := newEC2Handler(cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/latest/meta-data/hostname", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got, want := rec.Body.String(), "myhost\n"; got != want {
+		t.Fatalf("body = %q, want %q", got, want)
+	}
+}
+
+func TestEC2HandlerServeHTTPRequiresToken(t *testing.T) {
+	sc := &serverConfig{
+		Name:           "test",
+		InstanceConfig: &instanceConfig{Hostname: "myhost"},
+	}
+	cfg := &config{
+		ServerConfigs: []*serverConfig{sc},
+		EC2Compat:     &ec2Config{Enabled: true, BasePath: "/latest", RequireToken: true, serverConfig: sc},
+	}
+	h := newEC2Handler(cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/latest/meta-data/hostname", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d without a token", rec.Code, http.StatusUnauthorized)
+	}
+}
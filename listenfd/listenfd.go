@@ -0,0 +1,75 @@
+// Package listenfd adopts listening sockets passed to this process via
+// systemd socket activation (or a compatible launcher such as systemfd),
+// so the server can bind privileged ports or restart without dropping
+// in-flight connections.
+package listenfd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor systemd hands over; fds 0-2
+// remain stdin/stdout/stderr.
+const listenFDsStart = 3
+
+// Listeners returns the listeners backed by the file descriptors systemd
+// passed to this process, based on the LISTEN_PID and LISTEN_FDS
+// environment variables. It returns a nil slice, with no error, if the
+// process was not launched with any inherited listen sockets, or if
+// LISTEN_PID doesn't match this process (e.g. it was inherited by a child
+// process instead).
+func Listeners() ([]net.Listener, error) {
+	pid, fds, err := parseEnv()
+	if err != nil {
+		return nil, err
+	}
+	if fds == 0 || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	listeners := make([]net.Listener, 0, fds)
+	for i := 0; i < fds; i++ {
+		fd := listenFDsStart + i
+		file := os.NewFile(uintptr(fd), "listen-fd-"+strconv.Itoa(fd))
+		l, err := net.FileListener(file)
+		if err != nil {
+			return nil, fmt.Errorf("wrap fd %d as listener: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// TCPListener returns the first inherited TCP listener, or nil if none was
+// passed to this process.
+func TCPListener() (net.Listener, error) {
+	listeners, err := Listeners()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range listeners {
+		if _, ok := l.(*net.TCPListener); ok {
+			return l, nil
+		}
+	}
+	return nil, nil
+}
+
+func parseEnv() (pid int, fds int, err error) {
+	pidStr, fdsStr := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if pidStr == "" || fdsStr == "" {
+		return 0, 0, nil
+	}
+	pid, err = strconv.Atoi(pidStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse LISTEN_PID: %w", err)
+	}
+	fds, err = strconv.Atoi(fdsStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse LISTEN_FDS: %w", err)
+	}
+	return pid, fds, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+)
+
+// logLevel is the global floor every logger respects, set once at startup
+// from LOG_LEVEL (debug, info, warn, error; defaults to info).
+var logLevel = func() *slog.LevelVar {
+	lv := new(slog.LevelVar)
+	lv.Set(parseLogLevel(os.Getenv("LOG_LEVEL")))
+	return lv
+}()
+
+// debugPatterns are glob patterns from DEBUG (e.g. "config.*,http.match")
+// that elevate specific named loggers to debug level even when logLevel is
+// above debug.
+var debugPatterns = parseDebugPatterns(os.Getenv("DEBUG"))
+
+// rootHandler is shared by every named logger so they all write to the same
+// destination in the same format.
+var rootHandler = newRootHandler()
+
+var (
+	logConfig   = newLogger("config")
+	logHTTP     = newLogger("http")
+	logTemplate = newLogger("template")
+	logReload   = newLogger("reload")
+)
+
+func parseLogLevel(s string) slog.Level {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+func parseDebugPatterns(s string) []string {
+	if s == "" {
+		return nil
+	}
+	var patterns []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// newRootHandler emits JSON when stdout isn't a TTY (e.g. under systemd or
+// in a container, where structured logs are easier to ship), and key/value
+// text otherwise.
+func newRootHandler() slog.Handler {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	if isTerminal(os.Stdout) {
+		return slog.NewTextHandler(os.Stdout, opts)
+	}
+	return slog.NewJSONHandler(os.Stdout, opts)
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// newLogger returns a logger for the named component (config, http,
+// template, reload). Its debug output is suppressed unless logLevel is
+// already debug or name matches one of debugPatterns.
+func newLogger(name string) *slog.Logger {
+	return slog.New(&componentHandler{Handler: rootHandler, name: name})
+}
+
+// componentHandler wraps the shared rootHandler to apply per-component
+// debug filtering based on the DEBUG env var.
+type componentHandler struct {
+	slog.Handler
+	name string
+}
+
+func (h *componentHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if level >= logLevel.Level() {
+		return h.Handler.Enabled(ctx, level)
+	}
+	return level == slog.LevelDebug && matchesDebugPattern(h.name)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &componentHandler{Handler: h.Handler.WithAttrs(attrs), name: h.name}
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return &componentHandler{Handler: h.Handler.WithGroup(name), name: h.name}
+}
+
+// matchesDebugPattern reports whether name (one of config, http, template,
+// reload) is covered by one of debugPatterns. A trailing ".*" also matches
+// the bare component name, so "config.*" covers "config" itself and not
+// just hypothetical sub-scopes.
+func matchesDebugPattern(name string) bool {
+	for _, p := range debugPatterns {
+		if p == name {
+			return true
+		}
+		if ok, err := path.Match(p, name); err == nil && ok {
+			return true
+		}
+		if base, ok := strings.CutSuffix(p, ".*"); ok && base == name {
+			return true
+		}
+	}
+	return false
+}
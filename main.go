@@ -4,60 +4,155 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jalseth/nocloud-metadata-server/listenfd"
 )
 
+const watchDebounce = 200 * time.Millisecond
+
 var (
 	configFilePath = flag.String("config", "config.yaml", "Path to the config file.")
 )
 
 func main() {
+	flag.Parse()
+
 	cfg, err := loadConfig(*configFilePath)
 	if err != nil {
-		log.Fatal(err)
+		logConfig.Error("failed to load config", "error", err)
+		os.Exit(1)
 	}
 
 	reload := make(chan os.Signal, 1)
 	go func(sigs chan os.Signal) {
 		for range sigs {
-			log.Print("Config file modified, reloading")
+			logReload.Info("SIGHUP received, reloading config")
 			if err := cfg.reload(); err != nil {
-				log.Fatalf("Failed to reload updated config: %v", err)
+				logReload.Error("failed to reload updated config", "error", err)
+				os.Exit(1)
 			}
 		}
 	}(reload)
 	signal.Notify(reload, syscall.SIGHUP)
 
+	if err := watchConfig(cfg); err != nil {
+		logReload.Warn("failed to watch config file for changes, falling back to SIGHUP only", "error", err)
+	}
+
 	exit := make(chan os.Signal, 1)
 	signal.Notify(exit, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
+	mux := http.NewServeMux()
+	mux.Handle("/", newEC2Handler(cfg))
+
 	addr := fmt.Sprintf("%s:%d", cfg.ListenAddress, cfg.ListenPort)
 	srv := &http.Server{
 		Addr:    addr,
-		Handler: cfg,
+		Handler: mux,
+	}
+
+	listener, err := listenfd.TCPListener()
+	if err != nil {
+		logHTTP.Error("failed to adopt socket-activated listener", "error", err)
+		os.Exit(1)
 	}
+	srv.TLSConfig = cfg.tlsServerConfig()
+
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatal(err)
+		var serveErr error
+		switch {
+		case listener != nil && srv.TLSConfig != nil:
+			logHTTP.Info("listening on inherited socket", "addr", listener.Addr(), "tls", true)
+			serveErr = srv.ServeTLS(listener, "", "")
+		case listener != nil:
+			logHTTP.Info("listening on inherited socket", "addr", listener.Addr(), "tls", false)
+			serveErr = srv.Serve(listener)
+		case srv.TLSConfig != nil:
+			logHTTP.Info("listening", "addr", addr, "tls", true)
+			serveErr = srv.ListenAndServeTLS("", "")
+		default:
+			logHTTP.Info("listening", "addr", addr, "tls", false)
+			serveErr = srv.ListenAndServe()
+		}
+		if serveErr != nil && serveErr != http.ErrServerClosed {
+			logHTTP.Error("server exited", "error", serveErr)
+			os.Exit(1)
 		}
 	}()
-	log.Printf("Listening on %s", addr)
 
 	<-exit
-	log.Print("SIGTERM received, shutting down")
+	logHTTP.Info("signal received, shutting down")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal(err)
+		logHTTP.Error("error shutting down", "error", err)
+		os.Exit(1)
 	}
 }
 
-func init() {
-	flag.Parse()
+// watchConfig watches the directory containing cfg's config file for
+// changes and reloads cfg whenever the file itself is written, created, or
+// renamed. Watching the directory (rather than the file directly) is
+// necessary to survive editors that save by renaming a temp file over the
+// original, which would otherwise drop the watch on the original inode.
+//
+// Unlike the SIGHUP path, a reload failure here is logged and the
+// previously loaded config keeps serving, so a bad edit doesn't take the
+// server down.
+func watchConfig(cfg *config) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("create watcher: %w", err)
+	}
+
+	dir := filepath.Dir(cfg.configPath)
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return fmt.Errorf("watch %q: %w", dir, err)
+	}
+
+	target := filepath.Base(cfg.configPath)
+	go func() {
+		defer watcher.Close()
+		var debounce *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Base(event.Name) != target {
+					continue
+				}
+				if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) {
+					continue
+				}
+				if debounce == nil {
+					debounce = time.AfterFunc(watchDebounce, func() {
+						logReload.Info("config file changed on disk, reloading")
+						if err := cfg.reload(); err != nil {
+							logReload.Warn("failed to reload updated config, keeping previous config", "error", err)
+						}
+					})
+				} else {
+					debounce.Reset(watchDebounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logReload.Warn("config watcher error", "error", err)
+			}
+		}
+	}()
+
+	return nil
 }
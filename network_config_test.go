@@ -0,0 +1,95 @@
+package main
+
+import "testing"
+
+func TestNetworkConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		nc      networkConfig
+		wantErr bool
+	}{
+		{
+			name:    "version 1 rejected explicitly",
+			nc:      networkConfig{Version: 1},
+			wantErr: true,
+		},
+		{
+			name:    "unknown version rejected",
+			nc:      networkConfig{Version: 3},
+			wantErr: true,
+		},
+		{
+			name: "minimal v2 config is valid",
+			nc: networkConfig{
+				Version: 2,
+				Ethernets: map[string]*networkInterface{
+					"eth0": {DHCP4: true},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "duplicate matched interface name rejected",
+			nc: networkConfig{
+				Version: 2,
+				Ethernets: map[string]*networkInterface{
+					"eth0": {Match: &networkMatch{Name: "eth0"}},
+					"eth1": {Match: &networkMatch{Name: "eth0"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "two gateway4 fields rejected",
+			nc: networkConfig{
+				Version: 2,
+				Ethernets: map[string]*networkInterface{
+					"eth0": {Gateway4: "10.0.0.1"},
+					"eth1": {Gateway4: "10.0.1.1"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "gateway4 plus a 0.0.0.0/0 route rejected",
+			nc: networkConfig{
+				Version: 2,
+				Ethernets: map[string]*networkInterface{
+					"eth0": {Gateway4: "10.0.0.1"},
+					"eth1": {Routes: []networkRoute{{To: "0.0.0.0/0", Via: "10.0.1.1"}}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "one ipv4 and one ipv6 default gateway is fine",
+			nc: networkConfig{
+				Version: 2,
+				Ethernets: map[string]*networkInterface{
+					"eth0": {Gateway4: "10.0.0.1", Gateway6: "fe80::1"},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "two gateway6 fields rejected",
+			nc: networkConfig{
+				Version: 2,
+				Ethernets: map[string]*networkInterface{
+					"eth0": {Gateway6: "fe80::1"},
+					"eth1": {Gateway6: "fe80::2"},
+				},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.nc.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
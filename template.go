@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/GehirnInc/crypt"
+	_ "github.com/GehirnInc/crypt/sha512_crypt"
+)
+
+// userDataTemplateData is the data made available to a user-data template,
+// in addition to any named capture groups from the serverConfig's
+// matchPatterns, which are exposed under Match.
+type userDataTemplateData struct {
+	Serial     string
+	Hostname   string
+	RemoteAddr string
+	Match      map[string]string
+}
+
+// templateFuncs returns the helper functions available to user-data
+// templates.
+func templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"default":      defaultValue,
+		"hashPassword": hashPassword,
+		"readFile":     readFile,
+		"env":          os.Getenv,
+		"indent":       indent,
+	}
+}
+
+// defaultValue returns fallback if value is the empty string, otherwise
+// value. It mirrors sprig's "default" helper closely enough for cloud-init
+// templates without pulling in the whole library.
+func defaultValue(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// hashPassword returns a SHA-512 crypt hash of password, suitable for the
+// "passwd" field of a cloud-init chpasswd entry.
+func hashPassword(password string) (string, error) {
+	hash, err := crypt.SHA512.New().Generate([]byte(password), nil)
+	if err != nil {
+		return "", fmt.Errorf("hash password: %w", err)
+	}
+	return hash, nil
+}
+
+// readFile returns the contents of the file at path as a string.
+func readFile(path string) (string, error) {
+	by, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read file %q: %w", path, err)
+	}
+	return string(by), nil
+}
+
+// indent prefixes every line of s with n spaces.
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = pad + line
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		fallback string
+		want     string
+	}{
+		{name: "empty value uses fallback", value: "", fallback: "fallback", want: "fallback"},
+		{name: "non-empty value is kept", value: "set", fallback: "fallback", want: "set"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := defaultValue(tt.value, tt.fallback); got != tt.want {
+				t.Fatalf("defaultValue(%q, %q) = %q, want %q", tt.value, tt.fallback, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIndent(t *testing.T) {
+	got := indent(2, "a\nb")
+	want := "  a\n  b"
+	if got != want {
+		t.Fatalf("indent() = %q, want %q", got, want)
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := hashPassword("hunter2")
+	if err != nil {
+		t.Fatalf("hashPassword() error = %v", err)
+	}
+	if hash == "" || hash == "hunter2" {
+		t.Fatalf("hashPassword() returned unhashed or empty result: %q", hash)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("contents"), 0o600); err != nil {
+		t.Fatalf("write fixture: %v", err)
+	}
+
+	got, err := readFile(path)
+	if err != nil {
+		t.Fatalf("readFile() error = %v", err)
+	}
+	if got != "contents" {
+		t.Fatalf("readFile() = %q, want %q", got, "contents")
+	}
+
+	if _, err := readFile(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Fatal("readFile() on a missing file should return an error")
+	}
+}
+
+// TestConfigValidateChoosesTemplateEngineOnlyWhenNeeded exercises the
+// branch in config.validate that only compiles a text/template when the
+// rendered user-data YAML actually contains "{{", falling back to serving
+// the pure-YAML result as-is otherwise.
+func TestConfigValidateChoosesTemplateEngineOnlyWhenNeeded(t *testing.T) {
+	newConfig := func(userData map[string]any) *config {
+		return &config{
+			ServerConfigs: []*serverConfig{
+				{
+					Name:             "test",
+					MatchPatterns:    []string{".*"},
+					InstanceConfig:   &instanceConfig{Hostname: "host"},
+					UserDataTemplate: "ud",
+				},
+			},
+			UserDataTemplates: map[string]map[string]any{"ud": userData},
+		}
+	}
+
+	t.Run("static user-data is rendered without a template", func(t *testing.T) {
+		cfg := newConfig(map[string]any{"hostname": "static"})
+		if err := cfg.validate(); err != nil {
+			t.Fatalf("validate() error = %v", err)
+		}
+		sc := cfg.ServerConfigs[0]
+		if sc.userDataTmpl != nil {
+			t.Fatal("expected no compiled template for user-data without {{ directives")
+		}
+		if len(sc.renderedUserData) == 0 {
+			t.Fatal("expected renderedUserData to be populated")
+		}
+	})
+
+	t.Run("templated user-data compiles a template", func(t *testing.T) {
+		cfg := newConfig(map[string]any{"hostname": "{{ .Hostname }}"})
+		if err := cfg.validate(); err != nil {
+			t.Fatalf("validate() error = %v", err)
+		}
+		sc := cfg.ServerConfigs[0]
+		if sc.userDataTmpl == nil {
+			t.Fatal("expected a compiled template for user-data containing {{ directives")
+		}
+		if sc.renderedUserData != nil {
+			t.Fatal("expected renderedUserData to stay unset when a template is compiled")
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert generates a throwaway self-signed ECDSA cert/key pair
+// and writes them as PEM files under dir, returning their paths.
+func writeSelfSignedCert(t *testing.T, dir, prefix string) (certPath, keyPath string) {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: prefix},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	certPath = filepath.Join(dir, prefix+"-cert.pem")
+	keyPath = filepath.Join(dir, prefix+"-key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	return certPath, keyPath
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeSelfSignedCert(t, dir, "server")
+	caPath, _ := writeSelfSignedCert(t, dir, "ca")
+
+	t.Run("missing cert or key is rejected", func(t *testing.T) {
+		tc := &tlsConfig{KeyFile: keyPath}
+		if err := tc.validate(); err == nil {
+			t.Fatal("expected an error when certFile is unset")
+		}
+	})
+
+	t.Run("valid cert and key load successfully", func(t *testing.T) {
+		tc := &tlsConfig{CertFile: certPath, KeyFile: keyPath}
+		if err := tc.validate(); err != nil {
+			t.Fatalf("validate() error = %v", err)
+		}
+		if tc.cert == nil {
+			t.Fatal("expected cert to be loaded")
+		}
+	})
+
+	t.Run("unknown minVersion is rejected", func(t *testing.T) {
+		tc := &tlsConfig{CertFile: certPath, KeyFile: keyPath, MinVersion: "TLS9.9"}
+		if err := tc.validate(); err == nil {
+			t.Fatal("expected an error for an unknown minVersion")
+		}
+	})
+
+	t.Run("unknown clientAuth is rejected", func(t *testing.T) {
+		tc := &tlsConfig{CertFile: certPath, KeyFile: keyPath, ClientAuth: "BogusMode"}
+		if err := tc.validate(); err == nil {
+			t.Fatal("expected an error for an unknown clientAuth")
+		}
+	})
+
+	t.Run("clientCAFile defaults clientAuth to verifying mode", func(t *testing.T) {
+		tc := &tlsConfig{CertFile: certPath, KeyFile: keyPath, ClientCAFile: caPath}
+		if err := tc.validate(); err != nil {
+			t.Fatalf("validate() error = %v", err)
+		}
+		if tc.ClientAuth != "RequireAndVerifyClientCert" {
+			t.Fatalf("ClientAuth = %q, want RequireAndVerifyClientCert", tc.ClientAuth)
+		}
+		if tc.clientCAs == nil {
+			t.Fatal("expected clientCAs pool to be populated")
+		}
+	})
+
+	t.Run("explicit clientAuth is not overridden", func(t *testing.T) {
+		tc := &tlsConfig{CertFile: certPath, KeyFile: keyPath, ClientCAFile: caPath, ClientAuth: "VerifyClientCertIfGiven"}
+		if err := tc.validate(); err != nil {
+			t.Fatalf("validate() error = %v", err)
+		}
+		if tc.ClientAuth != "VerifyClientCertIfGiven" {
+			t.Fatalf("ClientAuth = %q, want VerifyClientCertIfGiven", tc.ClientAuth)
+		}
+	})
+}
+
+// TestConfigReloadRotatesCertificate verifies that reloading the config
+// after the on-disk cert/key change updates the *tls.Certificate served by
+// config.tlsServerConfig's GetCertificate, without needing a new listener.
+func TestConfigReloadRotatesCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeSelfSignedCert(t, dir, "first")
+
+	configPath := filepath.Join(dir, "config.yaml")
+	writeConfig := func() {
+		yaml := "listenPort: 8000\n" +
+			"serverConfigs:\n" +
+			"  - name: test\n" +
+			"    matchPatterns: [\".*\"]\n" +
+			"    instanceConfig:\n" +
+			"      hostname: host\n" +
+			"tls:\n" +
+			"  certFile: " + certPath + "\n" +
+			"  keyFile: " + keyPath + "\n"
+		if err := os.WriteFile(configPath, []byte(yaml), 0o600); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+	}
+	writeConfig()
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	first := cfg.cert.Load()
+	if first == nil {
+		t.Fatal("expected an initial certificate to be loaded")
+	}
+
+	certPath, keyPath = writeSelfSignedCert(t, dir, "second")
+	writeConfig()
+	if err := cfg.reload(); err != nil {
+		t.Fatalf("reload() error = %v", err)
+	}
+
+	second := cfg.cert.Load()
+	if second == nil {
+		t.Fatal("expected a certificate to still be loaded after reload")
+	}
+	if string(second.Certificate[0]) == string(first.Certificate[0]) {
+		t.Fatal("expected reload to rotate in the new certificate")
+	}
+}